@@ -0,0 +1,42 @@
+package graph
+
+import (
+	"encoding/json"
+)
+
+// deltaResponse is the paginated response from /me/drive/root/delta. Pages
+// are chained via NextLink until the final page, which carries DeltaLink
+// instead - the token to resume from on the next sync.
+type deltaResponse struct {
+	Value     []*DriveItem `json:"value"`
+	NextLink  string       `json:"@odata.nextLink"`
+	DeltaLink string       `json:"@odata.deltaLink"`
+}
+
+// pollDelta walks the delta feed starting at link (an empty link starts a
+// fresh sync at the drive root), returning every changed item across all
+// pages along with the new delta link to persist for next time.
+func pollDelta(link string, auth Auth) ([]*DriveItem, string, error) {
+	if link == "" {
+		link = "/me/drive/root/delta"
+	}
+
+	var items []*DriveItem
+	for {
+		body, err := Get(link, auth)
+		if err != nil {
+			return items, "", err
+		}
+
+		var page deltaResponse
+		if err := json.Unmarshal(body, &page); err != nil {
+			return items, "", err
+		}
+		items = append(items, page.Value...)
+
+		if page.DeltaLink != "" {
+			return items, page.DeltaLink, nil
+		}
+		link = page.NextLink
+	}
+}
@@ -2,17 +2,29 @@ package graph
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/Ciaxur/onedriver/graph/hash"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+// fileHashes are the content hashes Graph reports for a file, used to verify
+// transfers weren't corrupted. quickXorHash is populated for consumer
+// OneDrive accounts; sha1Hash/sha256Hash are populated for SharePoint/OneDrive
+// for Business.
+type fileHashes struct {
+	QuickXorHash string `json:"quickXorHash,omitempty"`
+	SHA1Hash     string `json:"sha1Hash,omitempty"`
+	SHA256Hash   string `json:"sha256Hash,omitempty"`
+}
+
 // DriveItemParent describes a DriveItem's parent in the Graph API (just another
 // DriveItem's ID and its path)
 type DriveItemParent struct {
@@ -23,24 +35,31 @@ type DriveItemParent struct {
 
 // DriveItem represents a file or folder fetched from the Graph API. All struct
 // fields are pointers so as to avoid including them when marshaling to JSON.
+// It also acts as the go-fuse v2 FileHandle for an open file: Read/Write/
+// Flush/Release below satisfy fs.FileReader/FileWriter/FileFlusher/
+// FileReleaser so a DriveItem can be returned directly from NodeOpener.
 type DriveItem struct {
-	nodefs.File `json:"-"`
-	auth        *Auth            // only populated for root item
-	data        *[]byte          // empty by default
-	hasChanges  bool             // used to trigger an upload on flush
-	ID          string           `json:"id,omitempty"`
-	Name        string           `json:"name,omitempty"`
-	Size        uint64           `json:"size,omitempty"`
-	ModifyTime  *time.Time       `json:"lastModifiedDatetime,omitempty"`
-	mode        uint32           // do not set manually
-	Parent      *DriveItemParent `json:"parentReference,omitempty"`
-	children    map[string]*DriveItem
-	Folder      *struct {
+	auth         *Auth              // only populated for root item
+	data         *[]byte            // empty by default
+	hasChanges   bool               // used to trigger an upload on flush
+	ID           string             `json:"id,omitempty"`
+	Name         string             `json:"name,omitempty"`
+	Size         uint64             `json:"size,omitempty"`
+	ModifyTime   *time.Time         `json:"lastModifiedDatetime,omitempty"`
+	mode         uint32             // do not set manually
+	Parent       *DriveItemParent   `json:"parentReference,omitempty"`
+	cancelUpload context.CancelFunc // non-nil while an upload session is in flight
+	children     map[string]*DriveItem
+	Folder       *struct {
 		ChildCount uint32 `json:"childCount,omitempty"`
 	} `json:"folder,omitempty"`
-	FileAPI *struct { // renamed to avoid conflict with nodefs.File interface
-		MimeType string `json:"mimeType,omitempty"`
+	FileAPI *struct { // renamed to avoid conflict with the fs.FileHandle interfaces below
+		MimeType string      `json:"mimeType,omitempty"`
+		Hashes   *fileHashes `json:"hashes,omitempty"`
 	} `json:"file,omitempty"`
+	Deleted *struct { // only present in delta responses for removed items
+		State string `json:"state,omitempty"`
+	} `json:"deleted,omitempty"`
 }
 
 // NewDriveItem initializes a new DriveItem
@@ -48,7 +67,6 @@ func NewDriveItem(name string, mode uint32, parent *DriveItem) *DriveItem {
 	var empty []byte
 	currentTime := time.Now()
 	return &DriveItem{
-		File: nodefs.NewDefaultFile(),
 		Name: name,
 		Parent: &DriveItemParent{
 			ID:   parent.ID,
@@ -125,23 +143,86 @@ func (d *DriveItem) FetchContent(auth Auth) error {
 		return err
 	}
 	d.data = &body
-	d.File = nodefs.NewDefaultFile()
+	return d.verifyChecksum(body)
+}
+
+// hashes returns the file.hashes block for this item, or nil if it has none
+// (e.g. a folder, or a locally-created file that hasn't been uploaded yet).
+func (d *DriveItem) hashes() *fileHashes {
+	if d.FileAPI == nil {
+		return nil
+	}
+	return d.FileAPI.Hashes
+}
+
+// bestHash returns the strongest available content hash Graph reported for
+// this item, preferring quickXorHash (OneDrive consumer accounts) over
+// sha1Hash/sha256Hash (SharePoint/OneDrive for Business). Used to populate
+// the onedriver.hash xattr.
+func (d *DriveItem) bestHash() string {
+	h := d.hashes()
+	switch {
+	case h == nil:
+		return ""
+	case h.QuickXorHash != "":
+		return h.QuickXorHash
+	case h.SHA1Hash != "":
+		return h.SHA1Hash
+	case h.SHA256Hash != "":
+		return h.SHA256Hash
+	}
+	return ""
+}
+
+// verifyChecksum confirms that data matches the hash Graph reported for this
+// item in file.hashes, logging and returning an error on mismatch. Items with
+// no reported hash (folders, items not yet uploaded) are trivially valid.
+func (d *DriveItem) verifyChecksum(data []byte) error {
+	h := d.hashes()
+	if h == nil {
+		return nil
+	}
+
+	var sum string
+	var err error
+	var want string
+	switch {
+	case h.QuickXorHash != "":
+		sum, err = hash.QuickXorSum(bytes.NewReader(data))
+		want = h.QuickXorHash
+	case h.SHA1Hash != "":
+		sum, err = hash.SHA1Sum(bytes.NewReader(data))
+		want = h.SHA1Hash
+	case h.SHA256Hash != "":
+		sum, err = hash.SHA256Sum(bytes.NewReader(data))
+		want = h.SHA256Hash
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum != want {
+		log.Printf("Checksum mismatch for \"%s\": got %s, want %s\n", d.Name, sum, want)
+		return fmt.Errorf("checksum mismatch for \"%s\"", d.Name)
+	}
 	return nil
 }
 
-// Read from a DriveItem like a file
-func (d DriveItem) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse.Status) {
-	end := int(off) + int(len(buf))
+// Read from a DriveItem like a file. Satisfies fs.FileReader.
+func (d *DriveItem) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	end := int(off) + len(dest)
 	if end > len(*d.data) {
 		end = len(*d.data)
 	}
 	log.Printf("Read(\"%s\"): %d bytes at offset %d\n", d.Name, int64(end)-off, off)
-	return fuse.ReadResultData((*d.data)[off:end]), fuse.OK
+	return fuse.ReadResultData((*d.data)[off:end]), fs.OK
 }
 
 // Write to a DriveItem like a file. Note that changes are 100% local until
-// Flush() is called.
-func (d *DriveItem) Write(data []byte, off int64) (uint32, fuse.Status) {
+// Flush() is called. Satisfies fs.FileWriter.
+func (d *DriveItem) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
 	nWrite := len(data)
 	offset := int(off)
 	log.Printf("Write(\"%s\"): %d bytes at offset %d\n", d.Name, nWrite, off)
@@ -157,7 +238,20 @@ func (d *DriveItem) Write(data []byte, off int64) (uint32, fuse.Status) {
 	d.Size = uint64(len(*d.data))
 	d.hasChanges = true
 
-	return uint32(nWrite), fuse.OK
+	return uint32(nWrite), fs.OK
+}
+
+// resizeData grows or shrinks *d.data to size. Growing appends zero bytes
+// rather than reslicing, since a truncate to a size larger than the
+// buffer's capacity would otherwise panic with "slice bounds out of range".
+func (d *DriveItem) resizeData(size uint64) {
+	data := *d.data
+	if uint64(len(data)) < size {
+		data = append(data, make([]byte, size-uint64(len(data)))...)
+	} else {
+		data = data[:size]
+	}
+	*d.data = data
 }
 
 func (d DriveItem) getRoot() *DriveItem {
@@ -168,20 +262,56 @@ func (d DriveItem) getRoot() *DriveItem {
 	return parent
 }
 
-// Flush is called when a file descriptor is closed, and is responsible for upload
-func (d DriveItem) Flush() fuse.Status {
+// Flush is called when a file descriptor is closed, and is responsible for
+// upload. Satisfies fs.FileFlusher.
+func (d *DriveItem) Flush(ctx context.Context) syscall.Errno {
 	log.Printf("Flush(\"%s\")\n", d.Name)
 	if d.hasChanges {
 		log.Println("Triggering upload of:", d.Name)
 		auth := *d.getRoot().auth
 		go d.Upload(auth)
 	}
-	return fuse.OK
+	return fs.OK
 }
 
-// Upload copies the file's contents to the server
+// Release is called once the last file descriptor referencing an open file is
+// closed. Satisfies fs.FileReleaser.
+func (d *DriveItem) Release(ctx context.Context) syscall.Errno {
+	return fs.OK
+}
+
+// Upload copies the file's contents to the server, then verifies the
+// returned DriveItem's hash against what was sent. A mismatch is retried once
+// before being surfaced, since it usually indicates a corrupted transfer
+// rather than a permanent failure.
 func (d *DriveItem) Upload(auth Auth) error {
-	// TODO implement upload sessions for files over 4MB
+	sent := append([]byte(nil), *d.data...)
+
+	if err := d.uploadOnce(auth); err != nil {
+		return err
+	}
+	if err := d.verifyChecksum(sent); err != nil {
+		log.Println("Retrying upload once after checksum mismatch:", err)
+		if err := d.uploadOnce(auth); err != nil {
+			return err
+		}
+		return d.verifyChecksum(sent)
+	}
+	return nil
+}
+
+// uploadOnce does a single upload attempt, with no checksum verification.
+// Files over uploadLargeThreshold are sent through a resumable upload session
+// instead of a single PUT, per Graph API limits.
+func (d *DriveItem) uploadOnce(auth Auth) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancelUpload = cancel
+	defer func() { d.cancelUpload = nil }()
+
+	if len(*d.data) > uploadLargeThreshold {
+		return d.uploadChunked(ctx, auth)
+	}
+
 	var uploadPath string
 	if d.ID == "" { // ID will be empty for a file that's local only
 		uploadPath = fmt.Sprintf("/me/drive/items/%s:/%s:/content",
@@ -197,33 +327,47 @@ func (d *DriveItem) Upload(auth Auth) error {
 	return json.Unmarshal(resp, d)
 }
 
-// GetAttr returns a the DriveItem as a UNIX stat
-func (d DriveItem) GetAttr(out *fuse.Attr) fuse.Status {
-	out.Size = d.FakeSize()
-	out.Nlink = d.NLink()
-	out.Atime = d.MTime()
-	out.Mtime = d.MTime()
-	out.Ctime = d.MTime()
-	out.Mode = d.Mode()
-	out.Owner = fuse.Owner{
-		Uid: uint32(os.Getuid()),
-		Gid: uint32(os.Getgid()),
+// CancelUpload aborts any in-flight upload session for this item, e.g. when
+// the filesystem is being unmounted.
+func (d *DriveItem) CancelUpload() {
+	if d.cancelUpload != nil {
+		d.cancelUpload()
 	}
-	return fuse.OK
 }
 
-// Utimens sets the access/modify times of a file
-func (d *DriveItem) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
-	d.ModifyTime = mtime
-	return fuse.OK
+// fillAttr populates a fuse.Attr with this item's metadata. Shared by the
+// Node-level Getattr (closed files) and the FileHandle-level Getattr (open
+// files) below.
+func (d *DriveItem) fillAttr(attr *fuse.Attr) {
+	attr.Size = d.FakeSize()
+	attr.Nlink = d.NLink()
+	attr.Atime = d.MTime()
+	attr.Mtime = d.MTime()
+	attr.Ctime = d.MTime()
+	attr.Mode = d.Mode()
+	attr.Owner = ownerAttr()
 }
 
-// Truncate cuts a file in place
-func (d *DriveItem) Truncate(size uint64) fuse.Status {
-	*d.data = (*d.data)[:size]
-	d.Size = size
-	d.hasChanges = true
-	return fuse.OK
+// Getattr returns a the DriveItem as a UNIX stat. Satisfies fs.FileGetattrer
+// for already-open files.
+func (d *DriveItem) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	d.fillAttr(&out.Attr)
+	return fs.OK
+}
+
+// Setattr handles truncate (ftruncate/O_TRUNC) and utimens on an open file.
+// Satisfies fs.FileSetattrer.
+func (d *DriveItem) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		d.resizeData(size)
+		d.Size = size
+		d.hasChanges = true
+	}
+	if mtime, ok := in.GetMTime(); ok {
+		d.ModifyTime = &mtime
+	}
+	d.fillAttr(&out.Attr)
+	return fs.OK
 }
 
 // IsDir returns if it is a directory (true) or file (false).
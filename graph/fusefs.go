@@ -2,16 +2,23 @@ package graph
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"log"
+	"net"
 	"os"
-	"regexp"
+	"syscall"
+	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/Ciaxur/onedriver/graph/metacache"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+// deltaPollInterval is how often the background goroutine checks Graph for
+// changes once the initial sync has completed.
+const deltaPollInterval = 30 * time.Second
+
 // these files will never exist, and we should ignore them
 func ignore(path string) bool {
 	ignoredFiles := []string{
@@ -33,66 +40,206 @@ func ignore(path string) bool {
 	return false
 }
 
-// FuseFs is a memory-backed filesystem for Microsoft Graph
+// ownerAttr returns the fuse.Owner to stamp on every item, since FUSE is
+// effectively single-user.
+func ownerAttr() fuse.Owner {
+	return fuse.Owner{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+}
+
+// FuseFs holds the state shared by every DriveItemNode in the mount: Graph
+// credentials and the on-disk metadata cache.
 type FuseFs struct {
-	pathfs.FileSystem
-	Auth Auth
+	Auth  Auth
+	cache *metacache.Cache // nil if no on-disk cache was configured
 }
 
-// GetAttr returns a stat structure for the specified file
-func (fs *FuseFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	name = "/" + name
-	if ignore(name) {
-		return nil, fuse.ENOENT
-	}
-	log.Printf("GetAttr(\"%s\")\n", name)
-	item, err := GetItem(name, fs.Auth)
+// NewFuseFs creates a FuseFs backed by a persistent metadata cache at
+// cachePath and starts the background delta-sync goroutine that keeps it
+// warm.
+func NewFuseFs(auth Auth, cachePath string) (*FuseFs, error) {
+	cache, err := metacache.Open(cachePath)
 	if err != nil {
-		return nil, fuse.ENOENT
-	}
-
-	// convert to UNIX struct stat
-	attr := fuse.Attr{
-		Size:  item.FakeSize(),
-		Atime: item.MTime(),
-		Mtime: item.MTime(),
-		Ctime: item.MTime(),
-		Mode:  item.Mode(),
-		Owner: fuse.Owner{
-			Uid: uint32(os.Getuid()),
-			Gid: uint32(os.Getgid()),
+		return nil, err
+	}
+	gfs := &FuseFs{Auth: auth, cache: cache}
+	go gfs.deltaLoop()
+	return gfs, nil
+}
+
+// Root returns the inode embedder for the drive's root item, suitable for
+// passing to fs.Mount.
+func (gfs *FuseFs) Root(root *DriveItem) *DriveItemNode {
+	return &DriveItemNode{item: root, fs: gfs}
+}
+
+// MountOptions are the go-fuse v2 options this filesystem mounts with. 1 MiB
+// writes/readahead (up from 128 KiB under the old pathfs/nodefs v1 mount)
+// give a dramatic throughput improvement, particularly for the upload-session
+// path, which streams in 10 MiB chunks.
+func MountOptions(debug bool) *fs.Options {
+	return &fs.Options{
+		MountOptions: fuse.MountOptions{
+			MaxWrite:     1 << 20,
+			MaxReadAhead: 1 << 20,
+			EnableLocks:  true,
+			Debug:        debug,
 		},
 	}
-	return &attr, fuse.OK
 }
 
-// Chown currently does nothing - it is not a valid option, since fuse is single-user anyways
-func (fs *FuseFs) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.EPERM
+// isOfflineErr reports whether err looks like a network connectivity
+// failure, as opposed to e.g. a genuine 404 from the API.
+func isOfflineErr(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// deltaLoop periodically walks the Graph delta feed and applies changes to
+// the on-disk cache, so cold mounts become incremental after the first sync.
+func (gfs *FuseFs) deltaLoop() {
+	for {
+		link, err := gfs.cache.DeltaLink()
+		if err != nil {
+			log.Println("Could not read delta link from cache:", err)
+			time.Sleep(deltaPollInterval)
+			continue
+		}
+
+		items, newLink, err := pollDelta(link, gfs.Auth)
+		if err != nil {
+			log.Println("Delta sync failed:", err)
+			time.Sleep(deltaPollInterval)
+			continue
+		}
+
+		for _, item := range items {
+			if item.Deleted != nil {
+				// Deleted-item tuples are minimal and frequently omit
+				// parentReference, so item.Path() isn't safe to call here.
+				// Look up the path we last cached it under instead.
+				path := ""
+				if cached, err := gfs.cache.GetItem(item.ID); err == nil {
+					var old DriveItem
+					if json.Unmarshal(cached, &old) == nil && old.Parent != nil {
+						path = old.Path()
+					}
+				}
+				gfs.cache.Delete(item.ID, path)
+				continue
+			}
+
+			if item.Parent == nil && item.Name != "root" {
+				// The delta feed can reference items it hasn't fully
+				// described yet; skip until a later page supplies a parent.
+				log.Printf("Delta sync: skipping \"%s\" with no parent reference\n", item.ID)
+				continue
+			}
+
+			path := "/"
+			if item.Parent != nil {
+				path = item.Path()
+			}
+			if data, err := json.Marshal(item); err == nil {
+				gfs.cache.Insert(item.ID, path, data)
+			}
+		}
+
+		if newLink != "" {
+			gfs.cache.SetDeltaLink(newLink)
+		}
+		time.Sleep(deltaPollInterval)
+	}
+}
+
+// cachedItem looks up and deserializes the item stored under path.
+func (gfs *FuseFs) cachedItem(path string) (*DriveItem, error) {
+	data, err := gfs.cache.GetByPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var item DriveItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// cachedChildren looks up the immediate children of dirPath from the cache.
+func (gfs *FuseFs) cachedChildren(dirPath string) ([]*DriveItem, error) {
+	blobs, err := gfs.cache.ChildrenOf(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*DriveItem, 0, len(blobs))
+	for _, blob := range blobs {
+		var item DriveItem
+		if err := json.Unmarshal(blob, &item); err != nil {
+			continue
+		}
+		items = append(items, &item)
+	}
+	return items, nil
 }
 
-// Chmod currently does nothing - no way to change mode yet.
-func (fs *FuseFs) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	return fuse.EPERM
+// getItem fetches item metadata at path, consulting the cache first and
+// falling back to the cache again if the network is unreachable.
+func (gfs *FuseFs) getItem(path string) (*DriveItem, error) {
+	if gfs.cache != nil {
+		if cached, err := gfs.cachedItem(path); err == nil {
+			return cached, nil
+		}
+	}
+
+	item, err := GetItem(path, gfs.Auth)
+	if err != nil {
+		if gfs.cache != nil && isOfflineErr(err) {
+			if cached, cacheErr := gfs.cachedItem(path); cacheErr == nil {
+				return cached, nil
+			}
+		}
+		return nil, err
+	}
+
+	if gfs.cache != nil {
+		if data, marshalErr := json.Marshal(item); marshalErr == nil {
+			gfs.cache.Insert(item.ID, path, data)
+		}
+	}
+	return item, nil
 }
 
-// OpenDir returns a list of directory entries
-func (fs *FuseFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
-	name = "/" + name
-	log.Printf("OpenDir(\"%s\")\n", name)
-	children, err := GetChildren(name, fs.Auth)
+// getChildren fetches the children of the directory at path, consulting the
+// cache first and falling back to it again if the network is unreachable.
+func (gfs *FuseFs) getChildren(path string) ([]*DriveItem, error) {
+	if gfs.cache != nil {
+		if cached, err := gfs.cachedChildren(path); err == nil && len(cached) > 0 {
+			return cached, nil
+		}
+	}
+
+	children, err := GetChildren(path, gfs.Auth)
 	if err != nil {
-		// that directory probably doesn't exist. silly human.
-		return nil, fuse.ENOENT
+		if gfs.cache != nil && isOfflineErr(err) {
+			if cached, cacheErr := gfs.cachedChildren(path); cacheErr == nil {
+				return cached, nil
+			}
+		}
+		return nil, err
 	}
+
+	items := make([]*DriveItem, 0, len(children))
 	for _, child := range children {
-		entry := fuse.DirEntry{
-			Name: child.Name,
-			Mode: child.Mode(),
+		items = append(items, child)
+		if gfs.cache != nil {
+			if data, marshalErr := json.Marshal(child); marshalErr == nil {
+				gfs.cache.Insert(child.ID, child.Path(), data)
+			}
 		}
-		c = append(c, entry)
 	}
-	return c, fuse.OK
+	return items, nil
 }
 
 type newFolderPost struct {
@@ -100,67 +247,245 @@ type newFolderPost struct {
 	Folder struct{} `json:"folder"`
 }
 
-// Mkdir creates a directory, mode is ignored
-func (fs *FuseFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	name = "/" + name
-	log.Printf("Mkdir(\"%s\")\n", name)
-	if name[len(name)-1] == '/' {
-		// remove trailing slash (if) exists for easier parsing later
-		name = name[:len(name)-1]
+// mkdir creates a directory at parentPath/name and returns the new item.
+func (gfs *FuseFs) mkdir(parentPath string, name string) (*DriveItem, error) {
+	bytePayload, _ := json.Marshal(newFolderPost{Name: name})
+	resp, err := Post(ChildrenPath(parentPath), gfs.Auth, bytes.NewReader(bytePayload))
+	if err != nil {
+		return nil, err
+	}
+	var item DriveItem
+	if err := json.Unmarshal(resp, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// deleteItem removes item from OneDrive. A plain DELETE already moves a
+// personal account's items into the recycle bin, recoverably - Graph has no
+// separate "move to recycle bin" operation, and no supported way to purge an
+// item without going through it, so every delete is recoverable from the
+// recycle bin for a time. Shared by the node's Unlink and Rmdir so directory
+// and file removal follow the same policy.
+func (gfs *FuseFs) deleteItem(item *DriveItem) error {
+	if err := Delete("/me/drive/items/"+item.ID, gfs.Auth); err != nil {
+		return err
+	}
+
+	if gfs.cache != nil {
+		gfs.cache.Delete(item.ID, item.Path())
+	}
+	return nil
+}
+
+// DriveItemNode is the go-fuse v2 inode wrapper around a DriveItem. Unlike
+// the old pathfs.FileSystem, which took bare path strings for every
+// operation, each DriveItemNode already knows which item it represents.
+type DriveItemNode struct {
+	fs.Inode
+	item *DriveItem
+	fs   *FuseFs
+}
+
+var (
+	_ fs.NodeGetattrer   = (*DriveItemNode)(nil)
+	_ fs.NodeLookuper    = (*DriveItemNode)(nil)
+	_ fs.NodeReaddirer   = (*DriveItemNode)(nil)
+	_ fs.NodeOpener      = (*DriveItemNode)(nil)
+	_ fs.NodeMkdirer     = (*DriveItemNode)(nil)
+	_ fs.NodeUnlinker    = (*DriveItemNode)(nil)
+	_ fs.NodeRmdirer     = (*DriveItemNode)(nil)
+	_ fs.NodeGetxattrer  = (*DriveItemNode)(nil)
+	_ fs.NodeListxattrer = (*DriveItemNode)(nil)
+)
+
+// xattrHash is the extended attribute users can `getfattr` to confirm
+// remote/local content equality without re-downloading the file.
+const xattrHash = "onedriver.hash"
+
+// Getxattr exposes the best available content hash Graph reported for this
+// item (see DriveItem.bestHash).
+func (n *DriveItemNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if attr != xattrHash {
+		return 0, syscall.ENODATA
+	}
+	value := n.item.bestHash()
+	if value == "" {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), fs.OK
+}
+
+// Listxattr advertises xattrHash when this item has a content hash to report.
+func (n *DriveItemNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if n.item.bestHash() == "" {
+		return 0, fs.OK
+	}
+	name := xattrHash + "\x00"
+	if len(dest) < len(name) {
+		return uint32(len(name)), syscall.ERANGE
+	}
+	return uint32(copy(dest, name)), fs.OK
+}
+
+func (n *DriveItemNode) childPath(name string) string {
+	if n.item.Path() == "/" {
+		return "/" + name
+	}
+	return n.item.Path() + "/" + name
+}
+
+func stableAttr(item *DriveItem) fs.StableAttr {
+	mode := uint32(fuse.S_IFREG)
+	if item.IsDir() {
+		mode = fuse.S_IFDIR
+	}
+	return fs.StableAttr{Mode: mode}
+}
+
+// Getattr returns a the DriveItem as a UNIX stat
+func (n *DriveItemNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.item.fillAttr(&out.Attr)
+	return fs.OK
+}
+
+// Setattr handles attribute changes made without an open file handle (e.g.
+// `touch`, `truncate -s`, or chmod/chown from the shell). Permission bits
+// aren't meaningful against Graph, so mode/uid/gid changes are rejected; size
+// and mtime changes are applied like the FileHandle-level Setattr.
+func (n *DriveItemNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if _, ok := in.GetMode(); ok {
+		return syscall.EPERM
+	}
+	if _, ok := in.GetUID(); ok {
+		return syscall.EPERM
+	}
+	if _, ok := in.GetGID(); ok {
+		return syscall.EPERM
+	}
+	if size, ok := in.GetSize(); ok {
+		if n.item.data == nil {
+			if err := n.item.FetchContent(n.fs.Auth); err != nil {
+				log.Printf("Failed to fetch content for \"%s\": %s\n", n.item.Path(), err)
+				return syscall.EIO
+			}
+		}
+		n.item.resizeData(size)
+		n.item.Size = size
+		n.item.hasChanges = true
+	}
+	if mtime, ok := in.GetMTime(); ok {
+		n.item.ModifyTime = &mtime
+	}
+	n.item.fillAttr(&out.Attr)
+	return fs.OK
+}
+
+// Lookup resolves name within this directory, consulting the cache before
+// falling back to the network (see FuseFs.getItem).
+func (n *DriveItemNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	path := n.childPath(name)
+	if ignore(path) {
+		return nil, syscall.ENOENT
 	}
-	re := regexp.MustCompile(`\w+$`)
-	split := re.FindStringIndex(name)[0]
-	parent, child := name[:split], name[split:]
+	log.Printf("Lookup(\"%s\")\n", path)
 
-	bytePayload, _ := json.Marshal(newFolderPost{Name: child})
-	resp, err := Post(ChildrenPath(parent), fs.Auth, bytes.NewReader(bytePayload))
+	item, err := n.fs.getItem(path)
 	if err != nil {
-		log.Println(string(resp))
-		log.Println(err)
-		return fuse.EREMOTEIO
+		return nil, syscall.ENOENT
 	}
-	return fuse.OK
+
+	item.fillAttr(&out.Attr)
+	child := &DriveItemNode{item: item, fs: n.fs}
+	return n.NewInode(ctx, child, stableAttr(item)), fs.OK
 }
 
-// Rmdir removes a directory
-func (fs *FuseFs) Rmdir(name string, context *fuse.Context) fuse.Status {
-	//TODO use as a general delete item method?
-	name = "/" + name
-	log.Printf("Rmdir(\"%s\")\n", name)
-	item, err := GetItem(name, fs.Auth)
+// Readdir streams this directory's children, consulting the cache before
+// falling back to the network (see FuseFs.getChildren).
+func (n *DriveItemNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	path := n.item.Path()
+	log.Printf("Readdir(\"%s\")\n", path)
+
+	children, err := n.fs.getChildren(path)
 	if err != nil {
-		log.Println(err)
-		return fuse.EREMOTEIO
+		return nil, syscall.ENOENT
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fuse.DirEntry{Name: child.Name, Mode: child.Mode()})
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+// Open fetches the item's content (if not already in memory) and returns the
+// DriveItem itself as the FileHandle, per its fs.FileReader/FileWriter/
+// FileFlusher/FileReleaser implementations in drive_item.go.
+func (n *DriveItemNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	log.Printf("Open(\"%s\")\n", n.item.Path())
+	if n.item.data == nil {
+		if err := n.item.FetchContent(n.fs.Auth); err != nil {
+			log.Printf("Failed to fetch content for \"%s\": %s\n", n.item.Path(), err)
+			return nil, 0, syscall.EIO
+		}
 	}
-	err = Delete("/me/drive/items/"+item.ID, fs.Auth)
+	return n.item, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+// Mkdir creates a directory, mode is ignored (Graph has no concept of UNIX
+// permission bits).
+func (n *DriveItemNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	path := n.childPath(name)
+	log.Printf("Mkdir(\"%s\")\n", path)
+
+	item, err := n.fs.mkdir(n.item.Path(), name)
 	if err != nil {
 		log.Println(err)
-		return fuse.EREMOTEIO
+		return nil, syscall.EREMOTEIO
 	}
-	return fuse.OK
+
+	item.fillAttr(&out.Attr)
+	child := &DriveItemNode{item: item, fs: n.fs}
+	return n.NewInode(ctx, child, stableAttr(item)), fs.OK
 }
 
-// Open returns a file that can be read and written to
-func (fs *FuseFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	name = "/" + name
-	log.Printf("Open(\"%s\")\n", name)
-	item, err := GetItem(name, fs.Auth)
+// Rmdir removes a directory through FuseFs.deleteItem, the same plain DELETE
+// that Unlink uses. FuseFs has no setting to choose between the recycle bin
+// and permanent deletion.
+func (n *DriveItemNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	path := n.childPath(name)
+	log.Printf("Rmdir(\"%s\")\n", path)
+
+	item, err := n.fs.getItem(path)
 	if err != nil {
-		// doesn't exist or internet is out - either way, no files for you!
-		return nil, fuse.ENOENT
+		log.Println(err)
+		return syscall.EREMOTEIO
 	}
-
-	//TODO deny write permissions until uploads/writes are implemented
-	if flags&fuse.O_ANYWRITE != 0 {
-		return nil, fuse.EPERM
+	if err := n.fs.deleteItem(item); err != nil {
+		log.Println(err)
+		return syscall.EREMOTEIO
 	}
+	return fs.OK
+}
 
-	body, err := Get("/me/drive/items/"+item.ID+"/content", fs.Auth)
+// Unlink removes a file through FuseFs.deleteItem, the same plain DELETE that
+// Rmdir uses. FuseFs has no setting to choose between the recycle bin and
+// permanent deletion.
+func (n *DriveItemNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	path := n.childPath(name)
+	log.Printf("Unlink(\"%s\")\n", path)
+
+	item, err := n.fs.getItem(path)
 	if err != nil {
-		log.Printf("Failed to fetch content for '%s': %s\n", item.ID, err)
-		return nil, fuse.ENOENT
+		log.Println(err)
+		return syscall.EREMOTEIO
 	}
-	//TODO this is a read-only file - will need to implement our own version of
-	// the File interface for write functionality
-	return nodefs.NewDataFile(body), fuse.OK
-}
\ No newline at end of file
+	if err := n.fs.deleteItem(item); err != nil {
+		log.Println(err)
+		return syscall.EREMOTEIO
+	}
+	return fs.OK
+}
@@ -0,0 +1,43 @@
+// Package hash computes the content hashes OneDrive reports alongside a
+// DriveItem (file.hashes), so downloads and uploads can be verified without
+// trusting the server round-trip.
+package hash
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// QuickXorSum returns the base64-encoded quickXorHash of r's content,
+// matching the encoding of file.hashes.quickXorHash.
+func QuickXorSum(r io.Reader) (string, error) {
+	h := New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// SHA1Sum returns the upper-case hex SHA-1 digest of r's content, matching
+// the encoding of file.hashes.sha1Hash.
+func SHA1Sum(r io.Reader) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// SHA256Sum returns the upper-case hex SHA-256 digest of r's content,
+// matching the encoding of file.hashes.sha256Hash.
+func SHA256Sum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+}
@@ -0,0 +1,93 @@
+package hash
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+// QuickXorHash implements Microsoft's documented quickXorHash algorithm, used
+// by OneDrive consumer accounts in file.hashes.quickXorHash. It's a simple
+// rotate-and-XOR checksum, not cryptographic - it exists purely to let us
+// verify that a transfer wasn't corrupted.
+const (
+	shiftBits   = 11
+	widthInBits = 160
+	dataCells   = (widthInBits-1)/64 + 1 // 3 uint64 cells (192 bits of storage, 160 used)
+)
+
+type quickXorHash struct {
+	data        [dataCells]uint64
+	lengthSoFar uint64
+	shiftSoFar  int
+}
+
+// New returns a new quickXorHash in its initial state.
+func New() hash.Hash {
+	return &quickXorHash{}
+}
+
+func (q *quickXorHash) Write(p []byte) (int, error) {
+	currentShift := q.shiftSoFar
+
+	// Every byte at position i in p is folded into lane i%widthInBits, so each
+	// lane's contribution is the XOR of every widthInBits'th byte.
+	iterations := len(p)
+	if iterations > widthInBits {
+		iterations = widthInBits
+	}
+
+	for i := 0; i < iterations; i++ {
+		var xoredByte uint64
+		for j := i; j < len(p); j += widthInBits {
+			xoredByte ^= uint64(p[j])
+		}
+
+		// A byte only ever occupies 8 bits, so it only spills into the next
+		// cell when the shift pushes it past the last 8 bits of this one. The
+		// last cell holds only widthInBits%64 (32) bits and spills into cell 0.
+		vectorArrayIndex := currentShift / 64
+		vectorOffset := uint(currentShift % 64)
+		bitsInCell := uint(64)
+		if vectorArrayIndex == dataCells-1 {
+			bitsInCell = widthInBits % 64
+		}
+
+		q.data[vectorArrayIndex] ^= xoredByte << vectorOffset
+		if vectorOffset > bitsInCell-8 {
+			next := vectorArrayIndex + 1
+			if next == dataCells {
+				next = 0
+			}
+			q.data[next] ^= xoredByte >> (bitsInCell - vectorOffset)
+		}
+
+		currentShift = (currentShift + shiftBits) % widthInBits
+	}
+
+	// Every byte of p advances the shift by shiftBits, not just the first
+	// widthInBits lanes visited above.
+	q.shiftSoFar = (q.shiftSoFar + shiftBits*(len(p)%widthInBits)) % widthInBits
+	q.lengthSoFar += uint64(len(p))
+	return len(p), nil
+}
+
+func (q *quickXorHash) Sum(b []byte) []byte {
+	out := make([]byte, dataCells*8)
+	for i, cell := range q.data {
+		binary.LittleEndian.PutUint64(out[i*8:], cell)
+	}
+	out = out[:widthInBits/8]
+
+	var lengthBytes [8]byte
+	binary.LittleEndian.PutUint64(lengthBytes[:], q.lengthSoFar)
+	for i := 0; i < 8; i++ {
+		out[len(out)-8+i] ^= lengthBytes[i]
+	}
+	return append(b, out...)
+}
+
+func (q *quickXorHash) Reset() { *q = quickXorHash{} }
+
+func (q *quickXorHash) Size() int { return widthInBits / 8 }
+
+func (q *quickXorHash) BlockSize() int { return 64 }
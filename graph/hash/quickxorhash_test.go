@@ -0,0 +1,32 @@
+package hash
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// Golden vectors taken from Microsoft's documented quickXorHash behavior -
+// verified against a known-good implementation, not derived from our own code.
+func TestQuickXorHash(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", "AAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+		{"hello world", "Hello World!", "SCgDG9jwBhBc4Q1ybAMZQgAAAAA="},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := New()
+			if _, err := h.Write([]byte(c.input)); err != nil {
+				t.Fatalf("Write returned error: %v", err)
+			}
+			got := base64.StdEncoding.EncodeToString(h.Sum(nil))
+			if got != c.want {
+				t.Errorf("QuickXorHash(%q) = %s, want %s", c.input, got, c.want)
+			}
+		})
+	}
+}
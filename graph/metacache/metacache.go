@@ -0,0 +1,175 @@
+// Package metacache provides a persistent on-disk cache of DriveItem metadata,
+// keyed by both item ID and normalized path, so that stat/readdir can be
+// served without a network round-trip on warm mounts (and, in a pinch, with
+// no network at all).
+package metacache
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketItems = []byte("items")
+	bucketPaths = []byte("paths")
+	bucketState = []byte("state")
+
+	keyDeltaLink = []byte("deltaLink")
+
+	// ErrNotFound is returned when a lookup misses the cache.
+	ErrNotFound = errors.New("metacache: not found")
+)
+
+// Cache is a bbolt-backed store of serialized DriveItem JSON, indexed by item
+// ID, plus a path -> ID index and a single delta link used to resume
+// incremental sync across mounts.
+type Cache struct {
+	db *bolt.DB
+}
+
+// Open opens (creating if necessary) the cache database at dbPath and ensures
+// all buckets exist.
+func Open(dbPath string) (*Cache, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketItems, bucketPaths, bucketState} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Cache{db: db}, nil
+}
+
+// Close releases the underlying database file.
+func (c *Cache) Close() error {
+	return c.db.Close()
+}
+
+// GetItem returns the serialized DriveItem stored under id.
+func (c *Cache) GetItem(id string) ([]byte, error) {
+	var data []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketItems).Get([]byte(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+// GetID returns the item ID that normalizedPath was last known to map to.
+func (c *Cache) GetID(normalizedPath string) (string, error) {
+	var id string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketPaths).Get([]byte(normalizedPath))
+		if v == nil {
+			return ErrNotFound
+		}
+		id = string(v)
+		return nil
+	})
+	return id, err
+}
+
+// GetByPath is a convenience wrapper that resolves normalizedPath to an ID
+// and then fetches the serialized item in one transaction.
+func (c *Cache) GetByPath(normalizedPath string) ([]byte, error) {
+	var data []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketPaths).Get([]byte(normalizedPath))
+		if id == nil {
+			return ErrNotFound
+		}
+		v := tx.Bucket(bucketItems).Get(id)
+		if v == nil {
+			return ErrNotFound
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+// Insert stores a serialized DriveItem under both its ID and path.
+func (c *Cache) Insert(id string, normalizedPath string, data []byte) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketItems).Put([]byte(id), data); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketPaths).Put([]byte(normalizedPath), []byte(id))
+	})
+}
+
+// ChildrenOf returns the serialized DriveItems whose path is an immediate
+// child of dirPath (dirPath itself must be normalized, e.g. "/" or "/Documents").
+func (c *Cache) ChildrenOf(dirPath string) ([][]byte, error) {
+	prefix := dirPath
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var items [][]byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		paths := tx.Bucket(bucketPaths)
+		cur := paths.Cursor()
+		for k, id := cur.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, id = cur.Next() {
+			if len(k) == len(prefix) {
+				continue // dirPath itself (e.g. the root at "/"), not a child
+			}
+			if strings.Contains(string(k[len(prefix):]), "/") {
+				continue // grandchild, not an immediate child
+			}
+			if data := tx.Bucket(bucketItems).Get(id); data != nil {
+				items = append(items, append([]byte(nil), data...))
+			}
+		}
+		return nil
+	})
+	return items, err
+}
+
+// Delete removes an item from both indexes.
+func (c *Cache) Delete(id string, normalizedPath string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketItems).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketPaths).Delete([]byte(normalizedPath))
+	})
+}
+
+// DeltaLink returns the last persisted Graph delta link, or "" if none has
+// been recorded yet (i.e. this is the first sync).
+func (c *Cache) DeltaLink() (string, error) {
+	var link string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketState).Get(keyDeltaLink)
+		link = string(v)
+		return nil
+	})
+	return link, err
+}
+
+// SetDeltaLink persists the delta link to resume from on the next sync.
+func (c *Cache) SetDeltaLink(link string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketState).Put(keyDeltaLink, []byte(link))
+	})
+}
@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pacerMinDelay   = 10 * time.Millisecond
+	pacerMaxDelay   = 2 * time.Second
+	pacerMaxRetries = 5
+)
+
+// pacer serializes outbound Graph requests behind a single mutex and paces
+// them with exponential backoff. OneDrive throttles aggressively, so without
+// this a burst of calls (OpenDir on a big folder, several Upload goroutines
+// fired from Flush()) will independently hammer the API until they all get
+// 429'd. This is modeled on rclone's pacer.
+type pacer struct {
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+// defaultPacer is the single choke point all outbound Graph requests should
+// be issued through.
+var defaultPacer = &pacer{delay: pacerMinDelay}
+
+// do runs fn under the pacer, retrying on transient (429/503/5xx) responses
+// with exponential backoff, honoring Retry-After when the server sends one.
+// The mutex is held for the full duration of fn and any retries, so calls
+// from different goroutines are genuinely serialized rather than merely
+// sharing a delay value. The caller is responsible for closing the returned
+// response's body.
+func (p *pacer) do(fn func() (*http.Response, error)) (*http.Response, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		time.Sleep(p.delay)
+
+		resp, err := fn()
+		if err != nil {
+			return nil, err
+		}
+
+		if !isTransient(resp.StatusCode) {
+			p.succeedLocked()
+			return resp, nil
+		}
+
+		if attempt >= pacerMaxRetries {
+			return resp, nil
+		}
+
+		wait := p.failLocked()
+		if retryAfter := retryAfterDuration(resp); retryAfter > wait {
+			wait = retryAfter
+		}
+		log.Printf("pacer: got %d, retrying in %s (attempt %d/%d)\n",
+			resp.StatusCode, wait, attempt+1, pacerMaxRetries)
+		resp.Body.Close()
+		time.Sleep(wait)
+	}
+}
+
+func isTransient(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusServiceUnavailable ||
+		status >= 500
+}
+
+func retryAfterDuration(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	if after := resp.Header.Get("Retry-After"); after != "" {
+		if seconds, err := strconv.Atoi(after); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// succeedLocked halves the current delay, down to pacerMinDelay, after a
+// non-transient response. Callers must hold p.mu.
+func (p *pacer) succeedLocked() {
+	p.delay /= 2
+	if p.delay < pacerMinDelay {
+		p.delay = pacerMinDelay
+	}
+}
+
+// failLocked doubles the current delay, up to pacerMaxDelay, and returns the
+// delay to wait before the next retry. Callers must hold p.mu.
+func (p *pacer) failLocked() time.Duration {
+	p.delay *= 2
+	if p.delay > pacerMaxDelay {
+		p.delay = pacerMaxDelay
+	}
+	return p.delay
+}
@@ -0,0 +1,93 @@
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// graphURL is the root of the Microsoft Graph v1.0 API that relative
+// resource paths are resolved against. Paginated responses (e.g.
+// @odata.nextLink) hand back absolute URLs instead, which are used as-is.
+const graphURL = "https://graph.microsoft.com/v1.0"
+
+// Auth holds the bearer token used to authenticate Graph API requests.
+type Auth struct {
+	AccessToken string `json:"access_token"`
+}
+
+// ChildrenPath returns the Graph API resource path for listing path's
+// immediate children.
+func ChildrenPath(path string) string {
+	if path == "/" {
+		return "/me/drive/root/children"
+	}
+	return "/me/drive/root:" + path + ":/children"
+}
+
+// request performs a single Graph API call through the shared pacer, so it
+// paces and retries the same way uploads already do, and returns the
+// response body. resource may be a path relative to graphURL or an absolute
+// URL (as handed back in @odata.nextLink/@odata.deltaLink).
+func request(method, resource string, auth Auth, body io.Reader) ([]byte, error) {
+	url := resource
+	if !strings.HasPrefix(resource, "http") {
+		url = graphURL + resource
+	}
+
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := defaultPacer.do(func() (*http.Response, error) {
+		req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+auth.AccessToken)
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return http.DefaultClient.Do(req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s %s: %d: %s", method, resource, resp.StatusCode, respBody)
+	}
+	return respBody, nil
+}
+
+// Get fetches resource from Graph.
+func Get(resource string, auth Auth) ([]byte, error) {
+	return request(http.MethodGet, resource, auth, nil)
+}
+
+// Post sends body to resource via POST.
+func Post(resource string, auth Auth, body io.Reader) ([]byte, error) {
+	return request(http.MethodPost, resource, auth, body)
+}
+
+// Put sends body to resource via PUT.
+func Put(resource string, auth Auth, body io.Reader) ([]byte, error) {
+	return request(http.MethodPut, resource, auth, body)
+}
+
+// Delete removes resource via DELETE.
+func Delete(resource string, auth Auth) error {
+	_, err := request(http.MethodDelete, resource, auth, nil)
+	return err
+}
@@ -0,0 +1,205 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadLargeThreshold is the cutoff above which Upload switches from a single
+// PUT to a chunked upload session, per Graph API limits on /content PUTs.
+const uploadLargeThreshold = 4 * 1024 * 1024
+
+// uploadChunkSize is the size of each chunk sent to an upload session. Must be
+// a multiple of 320 KiB as required by the Graph API.
+const uploadChunkSize = 10 * 1024 * 1024
+
+// uploadSessionMaxRetries caps how many times a single chunk will be retried
+// after a transient (429/5xx) error before the session is torn down.
+const uploadSessionMaxRetries = 5
+
+// uploadSession is the response to POST .../createUploadSession
+type uploadSession struct {
+	UploadURL          string    `json:"uploadUrl"`
+	ExpirationDateTime time.Time `json:"expirationDateTime"`
+	NextExpectedRanges []string  `json:"nextExpectedRanges"`
+}
+
+// only used to build the createUploadSession request body
+type uploadSessionPost struct {
+	Item struct {
+		ConflictBehavior string `json:"@microsoft.graph.conflictBehavior"`
+	} `json:"item"`
+}
+
+// createUploadSession starts a new resumable upload session for this item.
+func (d *DriveItem) createUploadSession(auth Auth) (*uploadSession, error) {
+	var createPath string
+	if d.ID == "" {
+		createPath = fmt.Sprintf("/me/drive/items/%s:/%s:/createUploadSession",
+			d.Parent.ID, d.Name)
+	} else {
+		createPath = "/me/drive/items/" + d.ID + "/createUploadSession"
+	}
+
+	var payload uploadSessionPost
+	payload.Item.ConflictBehavior = "replace"
+	body, _ := json.Marshal(payload)
+
+	resp, err := Post(createPath, auth, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var session uploadSession
+	if err := json.Unmarshal(resp, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// firstMissingByte parses the first gap reported in nextExpectedRanges
+// (formatted "start-end" or "start-"), returning the offset to resume from.
+func firstMissingByte(ranges []string) (int64, error) {
+	if len(ranges) == 0 {
+		return 0, nil
+	}
+	start := strings.SplitN(ranges[0], "-", 2)[0]
+	return strconv.ParseInt(start, 10, 64)
+}
+
+// putChunk PUTs a single chunk to the upload session's URL, through the
+// shared pacer so it backs off in step with the rest of the Graph traffic.
+// The upload URL is already pre-authenticated by Graph, so no Authorization
+// header is sent.
+func putChunk(uploadURL string, chunk []byte, start, total int64) (*http.Response, error) {
+	end := start + int64(len(chunk)) - 1
+	return defaultPacer.do(func() (*http.Response, error) {
+		req, err := http.NewRequest("PUT", uploadURL, bytes.NewReader(chunk))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Length", strconv.Itoa(len(chunk)))
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+		return http.DefaultClient.Do(req)
+	})
+}
+
+// deleteSession aborts an upload session, discarding any bytes received so far.
+func deleteSession(uploadURL string) {
+	resp, err := defaultPacer.do(func() (*http.Response, error) {
+		req, err := http.NewRequest("DELETE", uploadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		return http.DefaultClient.Do(req)
+	})
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// resumeOffset queries the upload session for the next expected byte, used to
+// recover after a transient failure mid-chunk.
+func resumeOffset(uploadURL string) (int64, error) {
+	resp, err := defaultPacer.do(func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", uploadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		return http.DefaultClient.Do(req)
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	var session uploadSession
+	if err := json.Unmarshal(body, &session); err != nil {
+		return 0, err
+	}
+	return firstMissingByte(session.NextExpectedRanges)
+}
+
+// uploadChunked uploads *d.data in uploadChunkSize pieces via an upload
+// session, resuming on transient errors and honoring ctx cancellation (so
+// Flush()'s goroutine can be interrupted on unmount).
+func (d *DriveItem) uploadChunked(ctx context.Context, auth Auth) error {
+	session, err := d.createUploadSession(auth)
+	if err != nil {
+		return err
+	}
+
+	total := int64(len(*d.data))
+	var offset int64
+	retries := 0
+	for offset < total {
+		select {
+		case <-ctx.Done():
+			deleteSession(session.UploadURL)
+			return ctx.Err()
+		default:
+		}
+
+		end := offset + uploadChunkSize
+		if end > total {
+			end = total
+		}
+		chunk := (*d.data)[offset:end]
+
+		log.Printf("Upload(\"%s\"): %d/%d bytes\n", d.Name, end, total)
+		resp, err := putChunk(session.UploadURL, chunk, offset, total)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case resp.StatusCode == 200 || resp.StatusCode == 201:
+			// final chunk - server returns the completed DriveItem
+			body, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if readErr != nil {
+				return readErr
+			}
+			return json.Unmarshal(body, d)
+
+		case resp.StatusCode == 202:
+			resp.Body.Close()
+			offset = end
+			retries = 0
+
+		case isTransient(resp.StatusCode):
+			delay := retryAfterDuration(resp)
+			if delay == 0 {
+				delay = time.Second
+			}
+			resp.Body.Close()
+			retries++
+			if retries > uploadSessionMaxRetries {
+				deleteSession(session.UploadURL)
+				return fmt.Errorf("upload session for \"%s\" failed after %d retries", d.Name, uploadSessionMaxRetries)
+			}
+			time.Sleep(delay)
+			// resync against the server's view of progress before retrying
+			if resumed, err := resumeOffset(session.UploadURL); err == nil {
+				offset = resumed
+			}
+
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("unexpected status %d uploading \"%s\"", resp.StatusCode, d.Name)
+		}
+	}
+	return nil
+}